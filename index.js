@@ -13,8 +13,15 @@
 // limitations under the License.
 
 const childProcess = require('child_process')
+const fs = require('fs')
+const http = require('http')
+const https = require('https')
+const net = require('net')
 const os = require('os')
+const path = require('path')
 const process = require('process')
+const readline = require('readline')
+const tls = require('tls')
 
 const VERSION = '4b7de504558cac5083795023fe26985549ef6e0b'
 
@@ -45,15 +52,571 @@ function chooseBinary() {
     process.exit(1)
 }
 
-function main() {
+// fail reports a failure as an error annotation and sets a non-zero exit
+// code. Like failures reported by the binary, it is downgraded to a warning
+// when `enforce` is false. The exit code is set rather than calling
+// `process.exit()` so that output written to a pipe is not truncated.
+function fail(enforce, message) {
+    if (!enforce) {
+        console.log(`::warning::${message}; not enforced`)
+        return
+    }
+    console.log(`::error::${message}`)
+    process.exitCode = 1
+}
+
+// invalidInput reports an input value that could not be parsed. When
+// enforced, the run fails and `null` is returned. Otherwise a warning is
+// logged and `defaultValue` is returned, so a typo does not stop a dry run
+// from evaluating anything.
+function invalidInput(enforce, name, value, defaultValue, defaultText) {
+    const message = `Invalid input; Input: "${name}", Value: "${value}"`
+    if (enforce) {
+        fail(enforce, message)
+        return null
+    }
+    console.log(`::warning::${message}; using the default (${defaultText})`)
+    return defaultValue
+}
+
+// booleanInput reads a boolean input, accepting the same spellings as
+// `getBooleanInput` in `@actions/core`. Returns `null` if the input is invalid.
+function booleanInput(name, defaultValue, enforce) {
+    const value = process.env[`INPUT_${name.toUpperCase()}`] || ''
+    if (value === '') {
+        return defaultValue
+    }
+    if (['true', 'True', 'TRUE'].includes(value)) {
+        return true
+    }
+    if (['false', 'False', 'FALSE'].includes(value)) {
+        return false
+    }
+    return invalidInput(enforce, name, value, defaultValue, String(defaultValue))
+}
+
+// childEnv builds the environment for the binary. Returns `null` if the token
+// could not be resolved.
+function childEnv(enforce) {
+    const env = { ...process.env }
+
+    const tokenFile = env['INPUT_GITHUB-TOKEN-FILE']
+    if (tokenFile) {
+        let token
+        try {
+            token = fs.readFileSync(tokenFile, 'utf8').trim()
+        } catch (err) {
+            fail(enforce, `Failed to read GitHub token file (${tokenFile}): ${err.message}`)
+            return null
+        }
+        if (!token) {
+            fail(enforce, `GitHub token file (${tokenFile}) is empty`)
+            return null
+        }
+        env['INPUT_GITHUB-TOKEN'] = token
+    }
+    if (!tokenFile && !env['INPUT_GITHUB-TOKEN'] && env.GITHUB_TOKEN) {
+        console.log('::notice::Input "github-token" is empty; using the GITHUB_TOKEN environment variable')
+        env['INPUT_GITHUB-TOKEN'] = env.GITHUB_TOKEN
+    }
+
+    // The binary's HTTP transport reads `HTTPS_PROXY` and `NO_PROXY`, so an
+    // explicit proxy only needs to be placed in its environment.
+    const proxyURL = env['INPUT_PROXY-URL']
+    if (proxyURL) {
+        env.HTTPS_PROXY = proxyURL
+    }
+
+    // On Linux the binary loads its root certificates from `SSL_CERT_FILE`;
+    // on macOS and Windows it uses the platform verifier, which ignores it.
+    const caCert = env['INPUT_CA-CERT']
+    if (caCert) {
+        if (os.platform() !== 'linux') {
+            fail(enforce, `Input "ca-cert" is only supported on Linux runners; Platform: ${os.platform()}`)
+            return null
+        }
+        if (caCert.trimStart().startsWith('-----BEGIN')) {
+            const dir = fs.mkdtempSync(path.join(env.RUNNER_TEMP || os.tmpdir(), 'ca-cert-'))
+            env.SSL_CERT_FILE = path.join(dir, 'ca.pem')
+            fs.writeFileSync(env.SSL_CERT_FILE, caCert)
+        } else if (fs.existsSync(caCert)) {
+            env.SSL_CERT_FILE = caCert
+        } else {
+            fail(enforce, `CA certificate file (${caCert}) does not exist`)
+            return null
+        }
+    }
+
+    // Register the token with the runner so it is masked in every log line
+    // written by the binary, including tokens read from a file that the
+    // runner does not already know to be secret.
+    const token = env['INPUT_GITHUB-TOKEN']
+    if (token) {
+        console.log(`::add-mask::${token}`)
+    }
+
+    return env
+}
+
+const DURATION_UNITS = {
+    ns: 1e-6,
+    us: 1e-3,
+    '\u00b5s': 1e-3, // U+00B5 = micro symbol
+    '\u03bcs': 1e-3, // U+03BC = Greek letter mu
+    ms: 1,
+    s: 1000,
+    m: 60 * 1000,
+    h: 60 * 60 * 1000,
+}
+
+// parseDuration converts a duration string (e.g. `1m30s`) into milliseconds,
+// following the grammar of Go's `time.ParseDuration` that the binary uses for
+// `timeout` and `interval`: an optional sign followed by one or more decimal
+// numbers, each with a unit suffix. Returns `NaN` for invalid input.
+function parseDuration(value) {
+    let rest = value
+    let sign = 1
+    if (rest[0] === '-' || rest[0] === '+') {
+        sign = rest[0] === '-' ? -1 : 1
+        rest = rest.slice(1)
+    }
+    if (rest === '0') {
+        return 0
+    }
+    if (rest === '') {
+        return NaN
+    }
+
+    const pattern = /(\d+(?:\.\d*)?|\.\d+)(ns|us|\u00b5s|\u03bcs|ms|s|m|h)/gy
+    let total = 0
+    let consumed = 0
+    let match
+    while ((match = pattern.exec(rest)) !== null) {
+        total += parseFloat(match[1]) * DURATION_UNITS[match[2]]
+        consumed = pattern.lastIndex
+    }
+    if (consumed !== rest.length) {
+        return NaN
+    }
+    return sign * total
+}
+
+function sleep(ms) {
+    Atomics.wait(new Int32Array(new SharedArrayBuffer(4)), 0, 0, ms)
+}
+
+// initialDelay sleeps for the `delay` input. Returns `false` if the input is
+// invalid and enforced.
+function initialDelay(enforce, quiet) {
+    const value = process.env['INPUT_DELAY'] || '0'
+    let ms = parseDuration(value)
+    if (Number.isNaN(ms) || ms < 0) {
+        ms = invalidInput(enforce, 'delay', value, 0, '0s')
+        if (ms === null) {
+            return false
+        }
+    }
+    if (ms > 0) {
+        if (!quiet) {
+            console.log(`Waiting ${value} before checking status`)
+        }
+        sleep(ms)
+    }
+    return true
+}
+
+// downgradeAnnotation rewrites an `::error` workflow command emitted by the
+// binary into a `::warning`, so unenforced failures are not shown as errors.
+function downgradeAnnotation(line) {
+    return line.replace(/^::error(?=[ :])/, '::warning')
+}
+
+function forEachLine(stream, callback) {
+    readline.createInterface({ input: stream, crlfDelay: Infinity }).on('line', callback)
+}
+
+// finish sets the exit code from the binary's result and returns the outcome
+// as a commit status state and description. In quiet mode it also prints the
+// one-line result, since the binary's own last line only names the last check
+// it looked at.
+function finish(code, signal, enforce, quiet) {
+    if (code === null) {
+        console.log(`::error::Action binary was terminated by signal ${signal}`)
+        process.exitCode = 1
+        return { state: 'error', description: `Terminated by signal ${signal}` }
+    }
+    if (code !== 0 && !enforce) {
+        console.log(`::warning::Conditional status checks did not pass (exit code ${code}); not enforced`)
+        return { state: 'success', description: 'Required checks did not pass (not enforced)' }
+    }
+    if (quiet) {
+        console.log(code === 0
+            ? 'Conditional status checks passed'
+            : `Conditional status checks did not pass (exit code ${code})`)
+    }
+    process.exitCode = code
+    if (code === 0) {
+        return { state: 'success', description: 'All required checks passed' }
+    }
+    return { state: 'failure', description: 'Required checks did not pass' }
+}
+
+// ANNOTATION matches workflow commands that are always passed through, even
+// in quiet mode, so failures still name the checks that caused them.
+const ANNOTATION = /^::(error|warning|notice|add-mask)(?=[ :])/
+
+// run starts the binary, sets the exit code from its result and resolves with
+// the outcome from `finish()`. When not enforced or in quiet mode, the binary's
+// output is read line by line: error annotations are downgraded to warnings
+// when not enforced, and quiet mode passes through only annotations.
+function run(mainScript, env, enforce, quiet) {
+    return new Promise((resolve) => runWith(mainScript, env, enforce, quiet, resolve))
+}
+
+function runWith(mainScript, env, enforce, quiet, resolve) {
+    const piped = !enforce || quiet
+    const child = childProcess.spawn(mainScript, { stdio: piped ? ['inherit', 'pipe', 'pipe'] : 'inherit', env })
+
+    const onLine = (write) => (line) => {
+        if (!quiet || ANNOTATION.test(line)) {
+            write(enforce ? line : downgradeAnnotation(line))
+        }
+    }
+    if (piped) {
+        forEachLine(child.stdout, onLine((line) => console.log(line)))
+        forEachLine(child.stderr, onLine((line) => console.error(line)))
+    }
+
+    // A spawn failure is followed by a 'close' event with a negative code,
+    // which must not replace the spawn error as the result.
+    let spawnError = null
+    child.on('error', (err) => {
+        spawnError = err
+        console.log(`::error::Failed to run action binary (${mainScript}): ${err.message}`)
+        process.exitCode = 1
+        resolve({ state: 'error', description: 'Action binary could not be started' })
+    })
+    child.on('close', (code, signal) => {
+        if (spawnError !== null) {
+            return
+        }
+        resolve(finish(code, signal, enforce, quiet))
+    })
+}
+
+// proxyFor returns the proxy to use for an HTTPS request to `url`, following
+// the `HTTPS_PROXY` and `NO_PROXY` rules of the binary's Go transport, or
+// `null` for a direct connection.
+function proxyFor(env, url) {
+    const hostname = url.hostname.replace(/^\[|\]$/g, '')
+    if (hostname === 'localhost' || (net.isIP(hostname) && (hostname.startsWith('127.') || hostname === '::1'))) {
+        return null
+    }
+    const noProxy = env.NO_PROXY || env.no_proxy || ''
+    for (const entry of noProxy.split(',').map((e) => e.trim()).filter(Boolean)) {
+        if (entry === '*') {
+            return null
+        }
+        const domain = entry.replace(/:\d+$/, '').replace(/^\*?\./, '')
+        if (hostname === domain || hostname.endsWith(`.${domain}`)) {
+            return null
+        }
+    }
+    const proxy = env.HTTPS_PROXY || env.https_proxy
+    if (!proxy) {
+        return null
+    }
+    return new URL(proxy.includes('://') ? proxy : `http://${proxy}`)
+}
+
+// tunnel opens a connection to `url` through an HTTP proxy with `CONNECT`.
+function tunnel(proxy, url) {
+    return new Promise((resolve, reject) => {
+        const headers = {}
+        if (proxy.username) {
+            const credentials = `${decodeURIComponent(proxy.username)}:${decodeURIComponent(proxy.password)}`
+            headers['Proxy-Authorization'] = `Basic ${Buffer.from(credentials).toString('base64')}`
+        }
+        const req = http.request({
+            host: proxy.hostname,
+            port: proxy.port || 80,
+            method: 'CONNECT',
+            path: `${url.hostname}:${url.port || 443}`,
+            headers,
+        })
+        req.on('connect', (res, socket) => {
+            if (res.statusCode !== 200) {
+                socket.destroy()
+                reject(new Error(`proxy CONNECT failed with status ${res.statusCode}`))
+                return
+            }
+            resolve(socket)
+        })
+        req.on('error', reject)
+        req.end()
+    })
+}
+
+// githubRequest sends a GitHub API request from the launcher. It uses the same
+// token, proxy and CA bundle that the binary is given in `env`, so launcher
+// requests work wherever the binary's do.
+async function githubRequest(env, method, apiPath, body) {
+    const base = (env.GITHUB_API_URL || 'https://api.github.com').replace(/\/+$/, '')
+    const url = new URL(`${base}${apiPath}`)
+    const options = {
+        method,
+        headers: {
+            Accept: 'application/vnd.github+json',
+            Authorization: `Bearer ${env['INPUT_GITHUB-TOKEN']}`,
+            'Content-Type': 'application/json',
+            'User-Agent': 'require-conditional-status-checks',
+        },
+    }
+    if (env.SSL_CERT_FILE) {
+        options.ca = [...tls.rootCertificates, fs.readFileSync(env.SSL_CERT_FILE, 'utf8')]
+    }
+    const proxy = url.protocol === 'https:' ? proxyFor(env, url) : null
+    if (proxy !== null) {
+        const socket = await tunnel(proxy, url)
+        options.createConnection = () => tls.connect({ socket, servername: url.hostname, ca: options.ca })
+    }
+
+    return new Promise((resolve, reject) => {
+        const client = url.protocol === 'http:' ? http : https
+        const req = client.request(url, options, (res) => {
+            const chunks = []
+            res.on('data', (chunk) => chunks.push(chunk))
+            res.on('end', () => resolve({ status: res.statusCode, body: Buffer.concat(chunks).toString() }))
+        })
+        req.on('error', reject)
+        req.setTimeout(30 * 1000, () => req.destroy(new Error('request timed out')))
+        req.end(body === undefined ? undefined : JSON.stringify(body))
+    })
+}
+
+// readPullRequest returns the parsed event payload and its pull request, or
+// `null` if the event is not a pull request event.
+function readPullRequest(env) {
+    try {
+        const event = JSON.parse(fs.readFileSync(env.GITHUB_EVENT_PATH, 'utf8'))
+        const pr = event.pull_request
+        if (pr && pr.base && pr.head && pr.head.sha) {
+            return { event, pr }
+        }
+    } catch (err) {
+        // Not a readable pull request event; the binary reports this.
+    }
+    return null
+}
+
+// headSHA returns the pull request head SHA from the event payload, or `null`.
+function headSHA(env) {
+    const payload = readPullRequest(env)
+    return payload === null ? null : payload.pr.head.sha
+}
+
+// rewriteBase points the binary at a copy of the event payload whose pull
+// request base SHA is `sha`. The binary compares that base with the head.
+function rewriteBase(env, event, sha) {
+    event.pull_request.base.sha = sha
+    const dir = fs.mkdtempSync(path.join(env.RUNNER_TEMP || os.tmpdir(), 'event-'))
+    env.GITHUB_EVENT_PATH = path.join(dir, 'event.json')
+    fs.writeFileSync(env.GITHUB_EVENT_PATH, JSON.stringify(event))
+}
+
+// compareModeInput reads the `compare-mode` input. Returns `null` if the input
+// is invalid and enforced.
+function compareModeInput(enforce) {
+    const value = process.env['INPUT_COMPARE-MODE'] || 'base-sha'
+    if (value === 'base-sha' || value === 'base-tip') {
+        return value
+    }
+    return invalidInput(enforce, 'compare-mode', value, 'base-sha', 'base-sha')
+}
+
+// useBaseTip makes the binary compare the head against the current tip of the
+// base branch rather than the base SHA captured in the event. Returns an error
+// message if the tip could not be read, otherwise `null`.
+async function useBaseTip(env, quiet) {
+    const payload = readPullRequest(env)
+    if (payload === null || !payload.pr.base.ref) {
+        return null
+    }
+    const { event, pr } = payload
+    let res
+    try {
+        res = await githubRequest(env, 'GET', `/repos/${env.GITHUB_REPOSITORY}/branches/${encodeURI(pr.base.ref)}`)
+    } catch (err) {
+        return `Failed to read the tip of base branch ${pr.base.ref}: ${err.message}`
+    }
+    if (res.status !== 200) {
+        return `Failed to read the tip of base branch ${pr.base.ref}; Status: ${res.status}`
+    }
+    const tip = JSON.parse(res.body).commit.sha
+    if (!quiet) {
+        console.log(`Comparing against the tip of ${pr.base.ref} (${tip}) instead of the event base SHA (${pr.base.sha})`)
+    }
+    rewriteBase(env, event, tip)
+    return null
+}
+
+// mergeBaseFallback handles a base SHA from the event that no longer exists
+// (garbage collected or force-pushed away). It compares against the merge base
+// of the head and the current base branch instead of letting the binary's
+// compare fail. Errors only skip the fallback.
+async function mergeBaseFallback(env) {
+    const payload = readPullRequest(env)
+    if (payload === null || !payload.pr.base.sha || !payload.pr.base.ref) {
+        return
+    }
+    const { event, pr } = payload
+    const repo = env.GITHUB_REPOSITORY
+    try {
+        const commit = await githubRequest(env, 'GET', `/repos/${repo}/commits/${pr.base.sha}`)
+        if (commit.status !== 404 && commit.status !== 422) {
+            return
+        }
+        const compare = await githubRequest(env, 'GET', `/repos/${repo}/compare/${encodeURI(pr.base.ref)}...${pr.head.sha}`)
+        if (compare.status !== 200) {
+            console.log(`::warning::Base SHA ${pr.base.sha} was not found and no merge base could be computed; Status: ${compare.status}`)
+            return
+        }
+        const mergeBase = JSON.parse(compare.body).merge_base_commit.sha
+        console.log(`::notice::Base SHA ${pr.base.sha} no longer exists; comparing against merge base ${mergeBase} with ${pr.base.ref}`)
+        rewriteBase(env, event, mergeBase)
+    } catch (err) {
+        console.log(`::warning::Skipping base SHA check: ${err.message}`)
+    }
+}
+
+// PREFLIGHT_CHECKS are the reads the binary makes, with the permission each
+// needs. The binary does not read commit statuses, so that permission is not
+// required here.
+const PREFLIGHT_CHECKS = [
+    { what: 'repository contents', permission: 'contents', path: (sha) => `/commits/${sha}` },
+    { what: 'check runs', permission: 'checks', path: (sha) => `/commits/${sha}/check-runs?per_page=1` },
+]
+
+// preflight verifies the token can make the reads the binary needs, so a
+// missing permission fails immediately with a message naming it rather than
+// as a 404 partway through the wait. Returns `false` if a permission is
+// missing. Anything other than a clear rejection only skips the check.
+async function preflight(env, enforce) {
+    const sha = headSHA(env)
+    if (sha === null || !env.GITHUB_REPOSITORY) {
+        return true
+    }
+    for (const check of PREFLIGHT_CHECKS) {
+        let res
+        try {
+            res = await githubRequest(env, 'GET', `/repos/${env.GITHUB_REPOSITORY}${check.path(sha)}`)
+        } catch (err) {
+            console.log(`::warning::Skipping GitHub token permission check: ${err.message}`)
+            return true
+        }
+        if (res.status === 401) {
+            fail(enforce, 'GitHub token was rejected by the GitHub API (401 Unauthorized)')
+            return false
+        }
+        if (res.status === 403 || res.status === 404) {
+            fail(
+                enforce,
+                `GitHub token cannot read ${check.what} in ${env.GITHUB_REPOSITORY} (HTTP ${res.status}); ` +
+                `it needs the "${check.permission}: read" permission`,
+            )
+            return false
+        }
+        if (res.status >= 300) {
+            console.log(`::warning::Skipping GitHub token permission check; Status: ${res.status}`)
+            return true
+        }
+    }
+    return true
+}
+
+// statusTarget returns where to post the summarizing commit status, or `null`
+// when the `status-context` input is not set.
+function statusTarget(env) {
+    const context = env['INPUT_STATUS-CONTEXT']
+    if (!context) {
+        return null
+    }
+    const sha = headSHA(env)
+    if (sha === null) {
+        console.log(`::warning::Not setting commit status "${context}"; the event has no pull request head SHA`)
+        return null
+    }
+    let targetURL
+    if (env.GITHUB_SERVER_URL && env.GITHUB_RUN_ID) {
+        targetURL = `${env.GITHUB_SERVER_URL}/${env.GITHUB_REPOSITORY}/actions/runs/${env.GITHUB_RUN_ID}`
+    }
+    return { context, sha, targetURL }
+}
+
+// setCommitStatus posts the summarizing commit status. Failures are reported
+// as warnings and never change the result of the action.
+async function setCommitStatus(env, target, outcome) {
+    if (target === null) {
+        return
+    }
+    const body = {
+        state: outcome.state,
+        context: target.context,
+        description: outcome.description,
+        target_url: target.targetURL,
+    }
+    try {
+        const res = await githubRequest(env, 'POST', `/repos/${env.GITHUB_REPOSITORY}/statuses/${target.sha}`, body)
+        if (res.status >= 300) {
+            console.log(`::warning::Failed to set commit status "${target.context}"; Status: ${res.status}`)
+        }
+    } catch (err) {
+        console.log(`::warning::Failed to set commit status "${target.context}": ${err.message}`)
+    }
+}
+
+async function main() {
     const binary = chooseBinary()
     const mainScript = `${__dirname}/${binary}`
-    const spawnSyncReturns = childProcess.spawnSync(mainScript, { stdio: 'inherit' })
-    const status = spawnSyncReturns.status
-    if (typeof status === 'number') {
-        process.exit(status)
+    const enforce = booleanInput('enforce', true, true)
+    if (enforce === null) {
+        return
     }
-    process.exit(1)
+    const quiet = booleanInput('quiet', false, enforce)
+    if (quiet === null) {
+        return
+    }
+    const compareMode = compareModeInput(enforce)
+    if (compareMode === null) {
+        return
+    }
+    const env = childEnv(enforce)
+    if (env === null) {
+        return
+    }
+    if (!(await preflight(env, enforce))) {
+        return
+    }
+    const target = statusTarget(env)
+    await setCommitStatus(env, target, { state: 'pending', description: 'Waiting for required checks' })
+    if (!initialDelay(enforce, quiet)) {
+        await setCommitStatus(env, target, { state: 'error', description: 'Invalid action input' })
+        return
+    }
+    if (compareMode === 'base-tip') {
+        const error = await useBaseTip(env, quiet)
+        if (error !== null) {
+            fail(enforce, error)
+            if (enforce) {
+                await setCommitStatus(env, target, { state: 'error', description: 'Could not read the base branch tip' })
+                return
+            }
+        }
+    } else {
+        await mergeBaseFallback(env)
+    }
+    const outcome = await run(mainScript, env, enforce, quiet)
+    await setCommitStatus(env, target, outcome)
 }
 
 if (require.main === module) {